@@ -37,6 +37,22 @@ type Rollout struct {
 	Configurations []ConfigurationRollout `json:"configurations,omitempty"`
 }
 
+// RolloutMode determines how traffic moves from the previous revision(s)
+// to the newest one for a given ConfigurationRollout.
+type RolloutMode string
+
+const (
+	// RolloutModeProgressive steps traffic incrementally from 1% up to
+	// 100%, per StepSize/StepDuration. This is the default, and is used
+	// when Mode is left empty, so existing annotations keep working.
+	RolloutModeProgressive RolloutMode = "Progressive"
+
+	// RolloutModeBlueGreen holds the new revision at 0% traffic until it
+	// has been warmed and (optionally) passed a pre-promotion analysis
+	// window, then flips all traffic to it in a single step.
+	RolloutModeBlueGreen RolloutMode = "BlueGreen"
+)
+
 // ConfigurationRollout describes the rollout state for a given config+tag pair.
 type ConfigurationRollout struct {
 	// Name + tag pair uniquely identifies the rollout target.
@@ -78,6 +94,270 @@ type ConfigurationRollout struct {
 
 	// How much traffic to move in a single step.
 	StepSize int `json:"stepSize,omitempty"`
+
+	// Mode selects the rollout strategy. Empty is equivalent to
+	// RolloutModeProgressive, so this field is safe to omit on
+	// existing, already serialized annotations.
+	Mode RolloutMode `json:"mode,omitempty"`
+
+	// PreviewReplicaCount is the number of replicas the new revision
+	// must have ready before traffic is flipped to it, in addition to
+	// PrePromotionDelay having elapsed. Zero disables the check. Only
+	// consulted when Mode is RolloutModeBlueGreen. A nil RevisionScaleReader
+	// passed to Step is treated as "not yet warmed" rather
+	// than skipping the check, so the gate holds rather than silently
+	// becoming a no-op when the caller hasn't wired a reader through.
+	PreviewReplicaCount int `json:"previewReplicaCount,omitempty"`
+
+	// PrePromotionDelay is how long to hold the new revision at 0%
+	// traffic before flipping traffic to it, counted from when
+	// ObserveReady first stamps the rollout. The PreviewReplicaCount
+	// check is made separately at flip time; the delay does not restart
+	// once the revision is warmed. Only consulted when Mode is
+	// RolloutModeBlueGreen.
+	PrePromotionDelay time.Duration `json:"prePromotionDelay,omitempty"`
+
+	// AutoPromote, when true, flips traffic to the new revision
+	// automatically once PreviewReplicaCount is warmed and
+	// PrePromotionDelay has elapsed. When false the rollout instead
+	// holds the new revision at 0% until AutoPromoteAfter elapses (if
+	// nonzero) or something flips Revisions externally by hand (e.g. an
+	// operator approving the promotion).
+	AutoPromote bool `json:"autoPromote,omitempty"`
+
+	// AutoPromoteAfter bounds how long a manual (AutoPromote: false)
+	// rollout holds at 0% before promoting anyway, as a safety valve
+	// against a forgotten approval step. Zero means wait indefinitely.
+	// Ignored when AutoPromote is true, since promotion already happens
+	// as soon as PrePromotionDelay elapses.
+	AutoPromoteAfter time.Duration `json:"autoPromoteAfter,omitempty"`
+
+	// ScaleDownDelay keeps the previous revision addressable (but at 0%
+	// traffic) for this long after the blue/green cutover, so a rollback
+	// does not have to pay a cold start.
+	ScaleDownDelay time.Duration `json:"scaleDownDelay,omitempty"`
+
+	// AdvanceThreshold is the error-rate delta (new revision minus the
+	// one it's replacing) at or above which the rollout holds its current
+	// split instead of advancing. Below this threshold StepSize is
+	// doubled on the next tick.
+	AdvanceThreshold float64 `json:"advanceThreshold,omitempty"`
+
+	// RollbackThreshold is the error-rate delta at or above which the rollout
+	// reverses direction via Rollback, draining the new revision back to
+	// zero. Must be >= AdvanceThreshold.
+	RollbackThreshold float64 `json:"rollbackThreshold,omitempty"`
+
+	// HealthSamples holds the last few error-rate delta samples used to
+	// reach the most recent AdvanceDecision, newest last. It is
+	// persisted so that decisions remain reproducible from the
+	// annotation alone, without needing to replay metrics history.
+	HealthSamples []float64 `json:"healthSamples,omitempty"`
+
+	// Decision is the outcome of the most recent Decide call. It is not
+	// persisted: callers re-derive it from live HealthSignal data on
+	// every reconcile, before invoking Step.
+	Decision AdvanceDecision `json:"-"`
+
+	// PrePromotionAnalysis is evaluated once the new revision reaches
+	// its first 1% of traffic, before Step steps it any further.
+	PrePromotionAnalysis []Metric `json:"prePromotionAnalysis,omitempty"`
+
+	// PostPromotionAnalysis is evaluated once the new revision reaches
+	// 100% of traffic, before the old revision is dropped from
+	// Revisions.
+	PostPromotionAnalysis []Metric `json:"postPromotionAnalysis,omitempty"`
+
+	// AnalysisState is the result of the most recently run analysis
+	// hook. While it is AnalysisRunning, Step holds at the 1% or 100%
+	// mark instead of advancing further.
+	AnalysisState AnalysisState `json:"analysisState,omitempty"`
+
+	// AnalysisFailures counts, per metric Name, consecutive failed
+	// evaluations across the currently running hook, so RunAnalysis can
+	// compare each metric's own streak against its own FailureLimit
+	// across calls without one metric's failures contaminating
+	// another's budget.
+	AnalysisFailures map[string]int `json:"analysisFailures,omitempty"`
+
+	// Phase marks a rollout that has left its normal forward flow, e.g.
+	// because a promotion analysis hook failed.
+	Phase RolloutPhase `json:"phase,omitempty"`
+
+	// MaxStepReplicaFraction caps how much the new revision is allowed
+	// to scale, relative to its desired replica count, to serve a
+	// single traffic step within StepDuration. If honoring StepSize
+	// would require scaling beyond this fraction, stepRevisions shrinks
+	// the step instead of overwhelming a cold revision. Zero disables
+	// the guardrail.
+	MaxStepReplicaFraction float64 `json:"maxStepReplicaFraction,omitempty"`
+}
+
+// RevisionScaleReader reports the current and desired replica counts
+// for a revision, so stepRevisions can guard against a traffic step
+// outrunning the new revision's ability to scale to meet it.
+type RevisionScaleReader interface {
+	// ReadyReplicas returns the number of ready pods currently backing
+	// revisionName.
+	ReadyReplicas(revisionName string) (int, error)
+	// DesiredReplicas returns how many replicas revisionName would need
+	// to serve 100% of its ConfigurationRollout's traffic.
+	DesiredReplicas(revisionName string) (int, error)
+}
+
+// AnalysisState is the result of evaluating a ConfigurationRollout's
+// Pre/PostPromotionAnalysis metrics.
+type AnalysisState string
+
+const (
+	// AnalysisRunning means the hook is still collecting samples.
+	// Step must not advance the rollout past the 1% or 100% mark while
+	// this holds.
+	AnalysisRunning AnalysisState = "Running"
+	// AnalysisSucceeded means every metric's SuccessCondition held
+	// within its FailureLimit; the rollout may proceed normally.
+	AnalysisSucceeded AnalysisState = "Succeeded"
+	// AnalysisFailed means a metric exceeded its FailureLimit. Seeing
+	// this also means Phase has been set to RolloutPhaseAborted.
+	AnalysisFailed AnalysisState = "Failed"
+)
+
+// RolloutPhase marks a ConfigurationRollout that has left its normal
+// forward (progressive/blue-green/adaptive) flow.
+type RolloutPhase string
+
+// RolloutPhaseAborted means a promotion analysis hook failed.
+// Subsequent Step calls drain the new revision back to 0%, paced by
+// StepDuration same as every other path, instead of stepping it
+// forward.
+const RolloutPhaseAborted RolloutPhase = "Aborted"
+
+// Metric is one provider-agnostic health check, evaluated by a
+// MetricProvider as part of Pre/PostPromotionAnalysis.
+type Metric struct {
+	// Name identifies the metric, e.g. "error-rate".
+	Name string `json:"name"`
+	// Query is passed verbatim to the MetricProvider; its syntax is
+	// provider-specific (PromQL, an HTTP JSON path, etc).
+	Query string `json:"query"`
+	// SuccessCondition is evaluated by the MetricProvider against the
+	// query result, e.g. "result < 0.01".
+	SuccessCondition string `json:"successCondition"`
+	// FailureLimit is how many consecutive failed evaluations are
+	// tolerated before the hook reports AnalysisFailed.
+	FailureLimit int `json:"failureLimit,omitempty"`
+	// Interval is how often the metric is (re-)evaluated.
+	Interval time.Duration `json:"interval,omitempty"`
+}
+
+// MetricProvider evaluates a Metric's Query against its
+// SuccessCondition. Implementations wrap a specific backend —
+// Prometheus, an HTTP JSON endpoint, or Knative's own built-in request
+// metrics — behind this one provider-agnostic method.
+type MetricProvider interface {
+	// Evaluate runs m.Query and reports whether SuccessCondition held.
+	Evaluate(m Metric) (bool, error)
+}
+
+// RunAnalysis evaluates metrics against provider and updates
+// AnalysisState (and AnalysisFailures/Phase on failure) accordingly.
+// Callers choose which of PrePromotionAnalysis or PostPromotionAnalysis
+// to pass in, based on whether the new revision is at its 1% or 100%
+// checkpoint, and are expected to call this before Step so Step can act
+// on the resulting state.
+func (cur *ConfigurationRollout) RunAnalysis(metrics []Metric, provider MetricProvider) (AnalysisState, error) {
+	if len(metrics) == 0 {
+		cur.AnalysisState = AnalysisSucceeded
+		return cur.AnalysisState, nil
+	}
+	running := false
+	for _, m := range metrics {
+		ok, err := provider.Evaluate(m)
+		if err != nil {
+			return cur.AnalysisState, err
+		}
+		if ok {
+			delete(cur.AnalysisFailures, m.Name)
+			continue
+		}
+		if cur.AnalysisFailures == nil {
+			cur.AnalysisFailures = map[string]int{}
+		}
+		cur.AnalysisFailures[m.Name]++
+		if cur.AnalysisFailures[m.Name] > m.FailureLimit {
+			cur.AnalysisState = AnalysisFailed
+			cur.Phase = RolloutPhaseAborted
+			return cur.AnalysisState, nil
+		}
+		running = true
+	}
+	if running {
+		cur.AnalysisState = AnalysisRunning
+		return cur.AnalysisState, nil
+	}
+	cur.AnalysisFailures = nil
+	cur.AnalysisState = AnalysisSucceeded
+	return cur.AnalysisState, nil
+}
+
+// AdvanceDecision is the outcome of evaluating a ConfigurationRollout's
+// HealthSignal ahead of a step.
+type AdvanceDecision string
+
+const (
+	// AdvanceDecisionAdvance means the observed error-rate delta is
+	// below AdvanceThreshold, so the next step doubles StepSize.
+	AdvanceDecisionAdvance AdvanceDecision = "Advance"
+	// AdvanceDecisionHold means the delta is between AdvanceThreshold
+	// and RollbackThreshold, so the current split is held and
+	// NextStepTime is pushed out without changing StepSize.
+	AdvanceDecisionHold AdvanceDecision = "Hold"
+	// AdvanceDecisionRollback means the delta is at or above
+	// RollbackThreshold, so traffic should be drained back off the new
+	// revision via Rollback.
+	AdvanceDecisionRollback AdvanceDecision = "Rollback"
+)
+
+// maxHealthSamples bounds how many ErrorRateDelta samples are kept on
+// HealthSamples, so the annotation doesn't grow unbounded over a long
+// rollout.
+const maxHealthSamples = 5
+
+// HealthSignal reports revision-level health used to drive adaptive
+// step sizing, typically backed by the success rate / p95 latency the
+// autoscaler and activator already collect for each revision.
+type HealthSignal interface {
+	// ErrorRateDelta returns how much higher (positive) or lower
+	// (negative) the newest revision's error rate is, as a fraction
+	// (0.01 == 1 percentage point), compared to the revision it is
+	// replacing.
+	ErrorRateDelta(cur *ConfigurationRollout) (float64, error)
+}
+
+// Decide samples signal, records it on HealthSamples, and returns the
+// AdvanceDecision the caller should act on for the next Step. It also
+// sets cur.Decision, which stepRevisions consults.
+func (cur *ConfigurationRollout) Decide(signal HealthSignal) (AdvanceDecision, error) {
+	delta, err := signal.ErrorRateDelta(cur)
+	if err != nil {
+		cur.Decision = AdvanceDecisionHold
+		return cur.Decision, err
+	}
+
+	cur.HealthSamples = append(cur.HealthSamples, delta)
+	if len(cur.HealthSamples) > maxHealthSamples {
+		cur.HealthSamples = cur.HealthSamples[len(cur.HealthSamples)-maxHealthSamples:]
+	}
+
+	switch {
+	case delta >= cur.RollbackThreshold:
+		cur.Decision = AdvanceDecisionRollback
+	case delta >= cur.AdvanceThreshold:
+		cur.Decision = AdvanceDecisionHold
+	default:
+		cur.Decision = AdvanceDecisionAdvance
+	}
+	return cur.Decision, nil
 }
 
 // RevisionRollout describes the revision in the config rollout.
@@ -88,6 +368,36 @@ type RevisionRollout struct {
 	// of total Route traffic, not the relative share of configuration
 	// target percentage.
 	Percent int `json:"percent"`
+
+	// Match pins requests matching any of these predicates to this
+	// revision, regardless of Percent. This lets a specific header or
+	// cookie value dogfood the revision before it takes any weighted
+	// traffic. Matched requests are out-of-band: they do not count
+	// against Percent and the ingress/activator translation layer is
+	// expected to evaluate Match ahead of the weighted split.
+	Match []MatchPredicate `json:"match,omitempty"`
+}
+
+// MatchPredicate pins a request to a revision when a header or cookie
+// has a particular value, mirroring the request-routing model used by
+// other rollout controllers (e.g. match-then-split).
+type MatchPredicate struct {
+	// Header is the name of the HTTP header to match. Exactly one of
+	// Header or Cookie must be set.
+	Header string `json:"header,omitempty"`
+	// Cookie is the name of the cookie to match. Exactly one of Header
+	// or Cookie must be set.
+	Cookie string `json:"cookie,omitempty"`
+
+	// Name is the header or cookie name to inspect.
+	Name string `json:"name"`
+
+	// ExactValue, if set, requires the header/cookie value to match
+	// exactly. Exactly one of ExactValue or Regex must be set.
+	ExactValue string `json:"exactValue,omitempty"`
+	// Regex, if set, requires the header/cookie value to match this
+	// regular expression. Exactly one of ExactValue or Regex must be set.
+	Regex string `json:"regex,omitempty"`
 }
 
 // Done returns true if there is no active rollout going on
@@ -114,25 +424,51 @@ func (cur *Rollout) Validate() bool {
 		if tot != c.Percent {
 			return false
 		}
+		// A blue/green rollout only ever flips between two revisions —
+		// the one being drained and the one being promoted. Anything
+		// else means the annotation was hand-edited or corrupted.
+		if c.Mode == RolloutModeBlueGreen && len(c.Revisions) > 2 {
+			return false
+		}
+		for _, r := range c.Revisions {
+			for _, m := range r.Match {
+				if !m.valid() {
+					return false
+				}
+			}
+		}
 	}
 	return true
 }
 
+// valid reports whether m sets exactly one of Header/Cookie and exactly
+// one of ExactValue/Regex, per their doc comments.
+func (m MatchPredicate) valid() bool {
+	if (m.Header != "") == (m.Cookie != "") {
+		return false
+	}
+	return (m.ExactValue != "") != (m.Regex != "")
+}
+
 // TODO(vagababov): default fake rollout duration in use, while we
 // only modify the annotation and do not actually modify the traffic.
+// This only seeds the first step; once a HealthSignal is wired up via
+// Decide, StepSize adapts every tick instead of following this fixed
+// schedule.
 const durationSecs = 120.0
 
 // ObserveReady traverses the configs and the ones that are in rollout
 // but have not observed step time yet, will have it set, to
-// max(1, nowTS-cfg.StartTime).
-func (cur *Rollout) ObserveReady(nowTS int) {
+// max(1, nowTS-cfg.StartTime). scaleReader may be nil, in which case
+// MaxStepReplicaFraction is not enforced.
+func (cur *Rollout) ObserveReady(nowTS int, scaleReader RevisionScaleReader) {
 	for i := range cur.Configurations {
 		c := &cur.Configurations[i]
 		if c.StepDuration == 0 && c.StartTime > 0 {
 			// In really ceil(nowTS-c.StartTime) should always give 1s, but
 			// given possible time drift, we'll ensure that at least 1s is returned.
 			minStepSec := math.Max(1, math.Ceil(time.Duration(nowTS-c.StartTime).Seconds()))
-			c.computeProperties(float64(nowTS), minStepSec, durationSecs)
+			c.computeProperties(float64(nowTS), minStepSec, durationSecs, scaleReader)
 		}
 	}
 }
@@ -142,7 +478,9 @@ func (cur *Rollout) ObserveReady(nowTS int) {
 // At the end of the call the returned object will contain the
 // desired traffic shape.
 // Step will return cur if no previous state was available.
-func (cur *Rollout) Step(prev *Rollout, nowTS int) *Rollout {
+// scaleReader may be nil, in which case MaxStepReplicaFraction is not
+// enforced for this call.
+func (cur *Rollout) Step(prev *Rollout, nowTS int, scaleReader RevisionScaleReader) *Rollout {
 	if prev == nil || len(prev.Configurations) == 0 {
 		return cur
 	}
@@ -185,7 +523,7 @@ func (cur *Rollout) Step(prev *Rollout, nowTS int) *Rollout {
 				// altogether.
 				switch p := ccfgs[i].Percent; {
 				case p > 1:
-					ret = append(ret, *stepConfig(ccfgs[i], pcfgs[j], nowTS))
+					ret = append(ret, *stepConfig(ccfgs[i], pcfgs[j], nowTS, scaleReader))
 				case p == 1:
 					// Skip all the work if it's a common A/B scenario where the test config
 					// receives just 1% of traffic.
@@ -225,86 +563,419 @@ func adjustPercentage(goal int, cr *ConfigurationRollout) {
 	case goal == 0:
 		cr.Revisions = nil // No traffic, no rollout.
 	case diff > 0:
-		cr.Revisions[len(cr.Revisions)-1].Percent += diff
+		// Matched revisions carry out-of-band traffic, not a share of
+		// Percent, so the increase always lands on the newest weighted
+		// (i.e. unmatched) revision.
+		if i := lastUnmatchedRevision(cr.Revisions); i >= 0 {
+			cr.Revisions[i].Percent += diff
+		}
 	case diff < 0:
 		diff = -diff // To make logic more natural.
+		out := cr.Revisions[:0:0]
 		i := 0
-		for diff > 0 && i < len(cr.Revisions) {
-			if cr.Revisions[i].Percent > diff {
-				cr.Revisions[i].Percent -= diff
-				break
+		for i < len(cr.Revisions) {
+			r := cr.Revisions[i]
+			// Matched revisions are out-of-band: they keep whatever
+			// Percent they already have (typically 0) regardless of
+			// the weighted reduction below.
+			if len(r.Match) > 0 {
+				out = append(out, r)
+				i++
+				continue
+			}
+			if diff == 0 {
+				out = append(out, r)
+				i++
+				continue
 			}
-			diff -= cr.Revisions[i].Percent
+			if r.Percent > diff {
+				r.Percent -= diff
+				diff = 0
+				out = append(out, r)
+				i++
+				continue
+			}
+			diff -= r.Percent
 			i++
 		}
-		cr.Revisions = cr.Revisions[i:]
+		cr.Revisions = out
 	default: // diff = 0
 		// noop
 	}
 }
 
+// lastUnmatchedRevision returns the index of the last revision that
+// isn't pinned by a Match predicate, or -1 if all revisions are matched.
+func lastUnmatchedRevision(revisions []RevisionRollout) int {
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if len(revisions[i].Match) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// blueGreenReadyToPromote reports whether a blue/green rollout may flip
+// traffic to the newest revision: PreviewReplicaCount (if set) must be
+// warmed, and either AutoPromote is set or AutoPromoteAfter has elapsed
+// since StartTime+PrePromotionDelay. A nil scaleReader is treated as
+// "not warmed" rather than skipping the check, since PreviewReplicaCount
+// is a safety gate: a caller that configures it without wiring a
+// RevisionScaleReader through should hold, not silently flip traffic to
+// a possibly-cold revision.
+func blueGreenReadyToPromote(goal *ConfigurationRollout, newest RevisionRollout, nowTS int, scaleReader RevisionScaleReader) bool {
+	if goal.PreviewReplicaCount > 0 {
+		if scaleReader == nil {
+			return false
+		}
+		ready, err := scaleReader.ReadyReplicas(newest.RevisionName)
+		if err != nil || ready < goal.PreviewReplicaCount {
+			return false
+		}
+	}
+	if goal.AutoPromote {
+		return true
+	}
+	if goal.AutoPromoteAfter <= 0 {
+		return false
+	}
+	baseline := goal.StartTime + int(goal.PrePromotionDelay.Seconds())
+	return nowTS >= baseline+int(goal.AutoPromoteAfter.Seconds())
+}
+
+// stepRevisionsBlueGreen performs the blue/green cutover. Once the
+// promotion time has arrived and blueGreenReadyToPromote agrees, it
+// flips all of the configuration's traffic to the newest revision, but
+// keeps the old revision(s) in Revisions at 0% for ScaleDownDelay, so a
+// rollback doesn't have to pay a cold start, before finally dropping
+// them.
+func stepRevisionsBlueGreen(goal *ConfigurationRollout, nowTS int, scaleReader RevisionScaleReader) {
+	revLen := len(goal.Revisions)
+	newest := &goal.Revisions[revLen-1]
+
+	if newest.Percent == goal.Percent {
+		// Already flipped; this tick just drops the old, zeroed-out
+		// revision(s) now that ScaleDownDelay has elapsed.
+		goal.Revisions = goal.Revisions[revLen-1:]
+		goal.NextStepTime = 0
+		return
+	}
+
+	if !blueGreenReadyToPromote(goal, *newest, nowTS, scaleReader) {
+		// Not warmed/approved yet: hold at 0% and check again next reconcile.
+		goal.NextStepTime = nowTS
+		return
+	}
+
+	newest.Percent = goal.Percent
+	for i := 0; i < revLen-1; i++ {
+		goal.Revisions[i].Percent = 0
+	}
+	goal.NextStepTime = nowTS + int(goal.ScaleDownDelay.Seconds())
+}
+
+// drainNewestRevision moves up to step percent of traffic from the
+// newest revision back onto the last unmatched revision before it,
+// dropping the newest revision from Revisions entirely once it reaches
+// 0%. Shared by Rollback and reverseAbortedRollout, which differ only
+// in why they were invoked, not in the traffic math.
+func drainNewestRevision(goal *ConfigurationRollout, step int) {
+	revLen := len(goal.Revisions)
+	newest := &goal.Revisions[revLen-1]
+	// Matched revisions are out-of-band, same as in adjustPercentage and
+	// stepRevisions: traffic must flow back to the last unmatched
+	// revision, not whichever one happens to sit right before newest.
+	giveBackIdx := lastUnmatchedRevision(goal.Revisions[:revLen-1])
+	if giveBackIdx < 0 {
+		// Every revision ahead of newest is Match-pinned, so there is no
+		// out-of-band-safe place to put this traffic. This only ever
+		// happens on the emergency-rollback paths (Rollback,
+		// reverseAbortedRollout): recovering off an unhealthy newest
+		// revision matters more here than preserving the out-of-band
+		// invariant for this one drain, so fall back to the oldest
+		// revision even though it's Match-pinned, rather than leaving
+		// newest stuck holding traffic forever.
+		giveBackIdx = 0
+	}
+	giveBack := &goal.Revisions[giveBackIdx]
+
+	if step <= 0 || step > newest.Percent {
+		step = newest.Percent
+	}
+	newest.Percent -= step
+	giveBack.Percent += step
+
+	if newest.Percent == 0 {
+		goal.Revisions = goal.Revisions[:revLen-1]
+	}
+}
+
+// Rollback reverses stepRevisions: it moves StepSize worth of traffic
+// from the newest revision back onto the one it was replacing, each
+// tick, until the newest revision reaches 0%, at which point it is
+// dropped from Revisions entirely. stepRevisions invokes it instead of
+// the progressive forward step whenever Decide has returned
+// AdvanceDecisionRollback; blue/green rollouts do not consult Decision.
+func (goal *ConfigurationRollout) Rollback(nowTS int) {
+	if nowTS < goal.NextStepTime || len(goal.Revisions) < 2 {
+		return
+	}
+	drainNewestRevision(goal, goal.StepSize)
+	goal.NextStepTime = nowTS + goal.StepDuration
+}
+
+// reverseAbortedRollout drains the newest revision back towards 0%,
+// paced by StepDuration same as every other path in this file, until it
+// is dropped from Revisions entirely, per RolloutPhaseAborted's
+// contract.
+func reverseAbortedRollout(goal *ConfigurationRollout, nowTS int) {
+	if nowTS < goal.NextStepTime || len(goal.Revisions) < 2 {
+		return
+	}
+	drainNewestRevision(goal, goal.StepSize)
+	goal.NextStepTime = nowTS + goal.StepDuration
+}
+
+// capStepToScaleGuard shrinks goal.StepSize, and pushes NextStepTime
+// out, if advancing by the full StepSize would require the newest
+// revision to scale beyond MaxStepReplicaFraction of its desired
+// replica count within StepDuration. stepRevisions restores the full
+// StepSize once its tick is done; when called from computeProperties,
+// the shrunk value becomes the rollout's starting StepSize. Replica counts are assumed to
+// scale linearly with traffic share, which is the same assumption the
+// autoscaler itself makes.
+func capStepToScaleGuard(goal *ConfigurationRollout, reader RevisionScaleReader, nowTS int) {
+	if reader == nil || goal.MaxStepReplicaFraction <= 0 || goal.Percent <= 0 || len(goal.Revisions) == 0 {
+		return
+	}
+	newest := goal.Revisions[len(goal.Revisions)-1]
+
+	ready, err := reader.ReadyReplicas(newest.RevisionName)
+	if err != nil {
+		return
+	}
+	desired, err := reader.DesiredReplicas(newest.RevisionName)
+	if err != nil || desired <= 0 {
+		return
+	}
+
+	postStepPercent := newest.Percent + goal.StepSize
+	if postStepPercent > goal.Percent {
+		postStepPercent = goal.Percent
+	}
+	neededReplicas := int(math.Ceil(float64(desired) * float64(postStepPercent) / float64(goal.Percent)))
+
+	maxReplicaDelta := int(math.Ceil(goal.MaxStepReplicaFraction * float64(desired)))
+	if maxReplicaDelta < 1 {
+		maxReplicaDelta = 1
+	}
+
+	if neededReplicas-ready <= maxReplicaDelta {
+		return
+	}
+
+	// Shrink the step so the revision only has to scale up by the
+	// guardrail's allowance this tick, and give it another StepDuration
+	// before trying to move further.
+	allowedPercent := int(math.Floor(float64(ready+maxReplicaDelta) * float64(goal.Percent) / float64(desired)))
+	newStepSize := allowedPercent - newest.Percent
+	if newStepSize < 1 {
+		newStepSize = 1
+	}
+	goal.StepSize = newStepSize
+	goal.NextStepTime = nowTS + goal.StepDuration
+}
+
 // stepRevisions performs re-adjustment of percentages on the revisions
-// to rollout more traffic to the last one.
-func stepRevisions(goal *ConfigurationRollout, nowTS int) {
+// to rollout more traffic to the last one. scaleReader may be nil, in
+// which case MaxStepReplicaFraction is not enforced.
+func stepRevisions(goal *ConfigurationRollout, nowTS int, scaleReader RevisionScaleReader) {
+	// A failed promotion analysis hook takes priority over everything
+	// else: it reverses, paced by StepDuration same as the forward
+	// steps below, until the new revision is fully drained.
+	if goal.Phase == RolloutPhaseAborted {
+		reverseAbortedRollout(goal, nowTS)
+		return
+	}
+
 	// Not yet ready to adjust the steps or we're done
 	// (shouldn't really be here, but better be defensive).
 	if nowTS < goal.NextStepTime || len(goal.Revisions) < 2 {
 		return
 	}
 
+	// A pre- or post-promotion analysis hook is still collecting
+	// samples: hold the current split rather than advance past the 1%
+	// or 100% mark. Callers are expected to only set AnalysisRunning at
+	// those two checkpoints.
+	if goal.AnalysisState == AnalysisRunning {
+		goal.NextStepTime = nowTS + goal.StepDuration
+		return
+	}
+
+	if goal.Mode == RolloutModeBlueGreen {
+		stepRevisionsBlueGreen(goal, nowTS, scaleReader)
+		return
+	}
+
+	// A PrePromotionAnalysis hook is configured and the newest revision
+	// has just reached its first 1% checkpoint (stamped by stepConfig
+	// when the rollout started): arm AnalysisRunning and hold here,
+	// mirroring the PostPromotionAnalysis arm below at the 100%
+	// checkpoint, so Step does not advance past 1% until the hook
+	// resolves. The AnalysisState != AnalysisSucceeded guard prevents
+	// re-arming on every later tick that happens to still read 1% (e.g.
+	// a Hold decision keeping the split frozen there) once the hook has
+	// already cleared this checkpoint once.
+	if len(goal.PrePromotionAnalysis) > 0 && goal.AnalysisState != AnalysisSucceeded && goal.Revisions[len(goal.Revisions)-1].Percent == 1 {
+		goal.AnalysisState = AnalysisRunning
+		goal.NextStepTime = nowTS + goal.StepDuration
+		return
+	}
+
+	// Adaptive (AIMD-style) step sizing: a caller that evaluated a
+	// HealthSignal via Decide sets Decision before calling Step. Plain
+	// progressive rollouts that never call Decide leave Decision at its
+	// zero value, which falls through to the unmodified equal-step math
+	// below.
+	switch goal.Decision {
+	case AdvanceDecisionRollback:
+		goal.Rollback(nowTS)
+		return
+	case AdvanceDecisionHold:
+		goal.NextStepTime = nowTS + goal.StepDuration
+		return
+	case AdvanceDecisionAdvance:
+		goal.StepSize *= 2
+		// Cap StepSize itself, not just the percent it produces this
+		// tick: otherwise a run of Advance decisions leaves StepSize
+		// arbitrarily oversized, and that stale value leaks into later
+		// Rollback/guardrail math even once this rollout has nothing
+		// left to advance.
+		if remaining := goal.Percent - goal.Revisions[len(goal.Revisions)-1].Percent; remaining > 0 && goal.StepSize > remaining {
+			goal.StepSize = remaining
+		}
+	}
+
+	// Guard against the step outrunning the new revision's ability to
+	// scale to meet it: shrink StepSize for this tick if honoring it
+	// would require more replicas than MaxStepReplicaFraction allows.
+	fullStepSize := goal.StepSize
+	capStepToScaleGuard(goal, scaleReader, nowTS)
+	defer func() { goal.StepSize = fullStepSize }()
+
+	// If this step would bring the newest revision to 100% while a
+	// PostPromotionAnalysis hook is configured, stop here instead of
+	// also collapsing the old revision away in the same tick: bump to
+	// 100% and zero out the older revision(s), but leave them in
+	// Revisions, so there's a "100%, old revision still present"
+	// checkpoint for a caller to run the hook against, per
+	// PostPromotionAnalysis's doc. AnalysisState is armed to
+	// AnalysisRunning here — discarding any stale AnalysisSucceeded left
+	// over from a PrePromotionAnalysis check at the 1% mark — so the
+	// hold persists, via the AnalysisState == AnalysisRunning check
+	// above, until the caller replaces it with Succeeded or Failed.
+	if revLen := len(goal.Revisions); len(goal.PostPromotionAnalysis) > 0 {
+		newest := &goal.Revisions[revLen-1]
+		// The strict less-than guards against re-arming (and thereby
+		// clobbering a caller-set AnalysisSucceeded back to Running)
+		// once this checkpoint has already fired once: on every tick
+		// after that, newest is already at goal.Percent, so this
+		// condition is false and control falls through to the normal
+		// redistribution below, which finishes dropping the old,
+		// already-zeroed revision(s).
+		if newest.Percent < goal.Percent && newest.Percent+goal.StepSize >= goal.Percent {
+			newest.Percent = goal.Percent
+			for i := 0; i < revLen-1; i++ {
+				goal.Revisions[i].Percent = 0
+			}
+			goal.AnalysisState = AnalysisRunning
+			goal.NextStepTime = nowTS + goal.StepDuration
+			return
+		}
+	}
+
 	revLen := len(goal.Revisions)
 	remaining := goal.StepSize
-	writePos := revLen - 1
-	// readPos is guaranteed to be >= 0, due to the check above.
-	readPos := revLen - 2
+
+	// Matched revisions are out-of-band, same as in adjustPercentage:
+	// they keep whatever Percent they already have (typically 0) and
+	// must never be treated as drained or culled below, regardless of
+	// where they sit in the list.
+	drop := make([]bool, revLen-1)
 
 	// If step > totalPercent then remaining will always be > 0
-	// even after readPos == -1.
+	// even after we've walked every unmatched revision.
 	// This is the case when config's target is reduced below step size.
 	// E.g. was: R1 = 40 R2 = 10 Step = 10 Total=60
 	// Now = Total = 15;
 	// After adjust percentage: R1 = 5 R2 = 10
 	// Then after first iteration R1 = 0, remaining = 5.
 	// We'll handle this situation below.
-	for remaining > 0 && readPos >= 0 {
+	for readPos := revLen - 2; remaining > 0 && readPos >= 0; readPos-- {
+		if len(goal.Revisions[readPos].Match) > 0 {
+			continue
+		}
 		// If this revision's allocation is strictly larger than the goal,
 		// just subtract the different and we're done.
 		if goal.Revisions[readPos].Percent > remaining {
 			goal.Revisions[readPos].Percent -= remaining
 			break
 		}
-		// Otherwise subtract what is possible and update
-		// write position since this revision will no longer
-		// receive traffic.
+		// Otherwise subtract what is possible and mark it for removal,
+		// since this revision will no longer receive traffic.
 		remaining -= goal.Revisions[readPos].Percent
-		writePos--
-		readPos--
+		drop[readPos] = true
 	}
-	// Copy the last one to the write pos
-	goal.Revisions[writePos] = goal.Revisions[revLen-1]
 
-	goal.Revisions[writePos].Percent += goal.StepSize
+	newest := goal.Revisions[revLen-1]
+	newest.Percent += goal.StepSize
 	// This can happen if step is now larger than total allocation, see the
 	// note above.
 	// E.g. with example above R2 = 20, and ro we have to cap it at 15.
-	if goal.Revisions[writePos].Percent > goal.Percent {
-		goal.Revisions[writePos].Percent = goal.Percent
+	if newest.Percent > goal.Percent {
+		newest.Percent = goal.Percent
 	}
-	// And cull the tail portion of it.
-	goal.Revisions = goal.Revisions[:writePos+1]
+
+	// Rebuild Revisions, culling anything marked for removal above but
+	// keeping every Match-pinned revision regardless of its Percent.
+	out := goal.Revisions[:0:0]
+	for i := 0; i < revLen-1; i++ {
+		if !drop[i] {
+			out = append(out, goal.Revisions[i])
+		}
+	}
+	goal.Revisions = append(out, newest)
 	// Also set the next time.
 	goal.NextStepTime = nowTS + goal.StepDuration
 }
 
 // stepConfig takes previous and goal configuration shapes and returns a new
-// config rollout, after computing the percetage allocations.
-func stepConfig(goal, prev *ConfigurationRollout, nowTS int) *ConfigurationRollout {
+// config rollout, after computing the percetage allocations. scaleReader
+// may be nil, in which case MaxStepReplicaFraction is not enforced.
+func stepConfig(goal, prev *ConfigurationRollout, nowTS int, scaleReader RevisionScaleReader) *ConfigurationRollout {
 	pc := len(prev.Revisions)
 	ret := &ConfigurationRollout{
-		ConfigurationName: goal.ConfigurationName,
-		Tag:               goal.Tag,
-		Percent:           goal.Percent,
-		Revisions:         goal.Revisions,
+		ConfigurationName:      goal.ConfigurationName,
+		Tag:                    goal.Tag,
+		Percent:                goal.Percent,
+		Revisions:              goal.Revisions,
+		Mode:                   goal.Mode,
+		PreviewReplicaCount:    goal.PreviewReplicaCount,
+		PrePromotionDelay:      goal.PrePromotionDelay,
+		AutoPromote:            goal.AutoPromote,
+		AutoPromoteAfter:       goal.AutoPromoteAfter,
+		ScaleDownDelay:         goal.ScaleDownDelay,
+		AdvanceThreshold:       goal.AdvanceThreshold,
+		RollbackThreshold:      goal.RollbackThreshold,
+		PrePromotionAnalysis:   goal.PrePromotionAnalysis,
+		PostPromotionAnalysis:  goal.PostPromotionAnalysis,
+		MaxStepReplicaFraction: goal.MaxStepReplicaFraction,
+
+		// HealthSamples, Decision, AnalysisState, AnalysisFailures and
+		// Phase are history, not desired state, so they're only ever
+		// carried forward from prev below, never from goal: see the
+		// "continuing rollout" branch.
 
 		// If there is a new revision, then timing information should be reset.
 		// So leave them empty here and populate below, if necessary.
@@ -328,10 +999,22 @@ func stepConfig(goal, prev *ConfigurationRollout, nowTS int) *ConfigurationRollo
 			ret.NextStepTime = prev.NextStepTime
 			ret.StepDuration = prev.StepDuration
 			ret.StartTime = prev.StartTime
+			// StepSize belongs to the in-flight rollout, same as the
+			// timing fields above — it may since have been doubled or
+			// held by an adaptive step, so it must come from prev too.
+			ret.StepSize = prev.StepSize
+			ret.HealthSamples = prev.HealthSamples
+			// Decision reflects this reconcile's Decide call (made
+			// against prev, where the accumulated HealthSamples live),
+			// not a stale value off goal.
+			ret.Decision = prev.Decision
+			ret.AnalysisState = prev.AnalysisState
+			ret.AnalysisFailures = prev.AnalysisFailures
+			ret.Phase = prev.Phase
 			// adjustPercentage above would've already accounted if target for the
 			// whole Configuration changed up or down. So here we should just redistribute
 			// the existing values.
-			stepRevisions(ret, nowTS)
+			stepRevisions(ret, nowTS, scaleReader)
 		}
 		return ret
 	}
@@ -339,6 +1022,25 @@ func stepConfig(goal, prev *ConfigurationRollout, nowTS int) *ConfigurationRollo
 	// Otherwise we start a rollout, which means we need to stamp the starttime.
 	ret.StartTime = nowTS
 
+	// Blue/green holds the new revision at 0% until it is promoted, so,
+	// unlike the progressive case below, we don't steal a percent from
+	// the previous revision(s) to seed it.
+	if goal.Mode == RolloutModeBlueGreen {
+		// Validate rejects any blue/green config with more than two
+		// Revisions, so prev.Revisions must collapse to a single entry
+		// here even if it still holds leftover {old@0, new@100} from a
+		// prior cutover sitting in its ScaleDownDelay grace window:
+		// carry only the currently-promoted revision forward, at
+		// goal.Percent, rather than every leftover entry.
+		promoted := prev.Revisions[pc-1]
+		promoted.Percent = goal.Percent
+		out := append(make([]RevisionRollout, 0, 2), promoted)
+		goalRev := goal.Revisions[0]
+		goalRev.Percent = 0
+		ret.Revisions = append(out, goalRev)
+		return ret
+	}
+
 	// Go backwards and find first revision with traffic assignment > 0.
 	// Reduce it by one, so we can give that 1% to the new revision.
 	// By design we drain newest revision first.
@@ -376,7 +1078,27 @@ func stepConfig(goal, prev *ConfigurationRollout, nowTS int) *ConfigurationRollo
 // nowTS current unix timestamp in ns.
 // Pre: minStepSec >= 1, in seconds.
 // Pre: durationSecs > 1, in seconds.
-func (cur *ConfigurationRollout) computeProperties(nowTS, minStepSec, durationSecs float64) {
+// scaleReader may be nil, in which case MaxStepReplicaFraction is not
+// enforced for the first step.
+func (cur *ConfigurationRollout) computeProperties(nowTS, minStepSec, durationSecs float64, scaleReader RevisionScaleReader) {
+	// Blue/green doesn't step incrementally: it holds at 0% until
+	// PrePromotionDelay elapses, then flips to 100% in stepRevisions
+	// once blueGreenReadyToPromote agrees.
+	if cur.Mode == RolloutModeBlueGreen {
+		// StepDuration has no pacing meaning for blue/green (the flip
+		// and subsequent drop are driven by NextStepTime directly), but
+		// ObserveReady uses StepDuration == 0 as its "not yet
+		// initialized" sentinel. Leaving it at zero here would make
+		// ObserveReady re-run this function — and re-stamp NextStepTime
+		// off a fresh nowTS — on every single reconcile, so the
+		// promotion deadline would never actually arrive. Stamp a
+		// non-zero placeholder instead.
+		cur.StepDuration = 1
+		cur.StepSize = 0
+		cur.NextStepTime = int(nowTS) + int(cur.PrePromotionDelay.Seconds())
+		return
+	}
+
 	// First compute number of steps.
 	numSteps := durationSecs / minStepSec
 	pf := float64(cur.Percent)
@@ -403,6 +1125,8 @@ func (cur *ConfigurationRollout) computeProperties(nowTS, minStepSec, durationSe
 	cur.StepDuration = int(stepDuration)
 	cur.StepSize = int(stepSize)
 	cur.NextStepTime = int(nowTS + stepDuration*float64(time.Second))
+
+	capStepToScaleGuard(cur, scaleReader, int(nowTS))
 }
 
 // sortRollout sorts the rollout based on tag so it's consistent
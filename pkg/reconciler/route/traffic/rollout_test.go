@@ -0,0 +1,675 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package traffic
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeScaleReader is a trivial RevisionScaleReader backed by maps, so
+// tests can drive ReadyReplicas/DesiredReplicas per revision name.
+type fakeScaleReader struct {
+	ready, desired map[string]int
+}
+
+func (f *fakeScaleReader) ReadyReplicas(name string) (int, error) {
+	v, ok := f.ready[name]
+	if !ok {
+		return 0, errors.New("no such revision")
+	}
+	return v, nil
+}
+
+func (f *fakeScaleReader) DesiredReplicas(name string) (int, error) {
+	v, ok := f.desired[name]
+	if !ok {
+		return 0, errors.New("no such revision")
+	}
+	return v, nil
+}
+
+func blueGreenGoal() *ConfigurationRollout {
+	return &ConfigurationRollout{
+		ConfigurationName: "cfg",
+		Percent:           100,
+		Mode:              RolloutModeBlueGreen,
+		StartTime:         1000,
+		Revisions: []RevisionRollout{
+			{RevisionName: "old", Percent: 100},
+			{RevisionName: "new", Percent: 0},
+		},
+	}
+}
+
+// TestObserveReadyBlueGreenStampsOnce verifies that a blue/green
+// rollout's NextStepTime is only stamped once, even across repeated
+// ObserveReady calls, so the promotion deadline doesn't perpetually
+// slide into the future.
+func TestObserveReadyBlueGreenStampsOnce(t *testing.T) {
+	goal := blueGreenGoal()
+	goal.PrePromotionDelay = 30 * time.Second
+	ro := &Rollout{Configurations: []ConfigurationRollout{*goal}}
+
+	ro.ObserveReady(1000, nil)
+	want := ro.Configurations[0].NextStepTime
+	if want != 1030 {
+		t.Fatalf("NextStepTime after first ObserveReady = %d, want 1030", want)
+	}
+
+	// A later reconcile should not re-stamp NextStepTime off the new nowTS.
+	ro.ObserveReady(1020, nil)
+	if got := ro.Configurations[0].NextStepTime; got != want {
+		t.Fatalf("NextStepTime after second ObserveReady = %d, want unchanged %d", got, want)
+	}
+}
+
+// TestStepRevisionsBlueGreenHoldsUntilReady verifies that the flip is
+// gated on PreviewReplicaCount being warmed before it happens.
+func TestStepRevisionsBlueGreenHoldsUntilReady(t *testing.T) {
+	goal := blueGreenGoal()
+	goal.AutoPromote = true
+	goal.PreviewReplicaCount = 3
+	goal.NextStepTime = 1000
+
+	reader := &fakeScaleReader{ready: map[string]int{"new": 1}, desired: map[string]int{"new": 3}}
+	stepRevisions(goal, 1000, reader)
+
+	if len(goal.Revisions) != 2 || goal.Revisions[1].Percent != 0 {
+		t.Fatalf("expected flip to be held while under-warmed, got %+v", goal.Revisions)
+	}
+
+	reader.ready["new"] = 3
+	stepRevisions(goal, 1001, reader)
+	if goal.Revisions[1].Percent != 100 {
+		t.Fatalf("expected flip once warmed, got %+v", goal.Revisions)
+	}
+}
+
+// TestStepRevisionsBlueGreenHoldsWithNilScaleReader verifies that a
+// PreviewReplicaCount gate holds the flip rather than silently becoming
+// a no-op when no RevisionScaleReader is wired through.
+func TestStepRevisionsBlueGreenHoldsWithNilScaleReader(t *testing.T) {
+	goal := blueGreenGoal()
+	goal.AutoPromote = true
+	goal.PreviewReplicaCount = 3
+	goal.NextStepTime = 1000
+
+	stepRevisions(goal, 1000, nil)
+
+	if goal.Revisions[1].Percent != 0 {
+		t.Fatalf("expected flip to be held with nil scaleReader and PreviewReplicaCount set, got %+v", goal.Revisions)
+	}
+}
+
+// TestStepRevisionsBlueGreenManualPromotion verifies that AutoPromote:
+// false holds indefinitely without AutoPromoteAfter, and promotes once
+// AutoPromoteAfter elapses when set.
+func TestStepRevisionsBlueGreenManualPromotion(t *testing.T) {
+	goal := blueGreenGoal()
+	goal.NextStepTime = 1000
+
+	stepRevisions(goal, 1000, nil)
+	if goal.Revisions[1].Percent != 0 {
+		t.Fatalf("manual promotion flipped without AutoPromote: %+v", goal.Revisions)
+	}
+
+	goal.AutoPromoteAfter = 10 * time.Second
+	stepRevisions(goal, 1005, nil)
+	if goal.Revisions[1].Percent != 0 {
+		t.Fatalf("promoted before AutoPromoteAfter elapsed: %+v", goal.Revisions)
+	}
+
+	stepRevisions(goal, 1010, nil)
+	if goal.Revisions[1].Percent != 100 {
+		t.Fatalf("expected promotion once AutoPromoteAfter elapsed: %+v", goal.Revisions)
+	}
+}
+
+// TestStepConfigBlueGreenCollapsesLeftoverRevisions verifies that
+// starting a new blue/green rollout while prev.Revisions still holds a
+// leftover {old@0, new@100} pair from a prior cutover (e.g. still inside
+// its ScaleDownDelay grace window) collapses down to a single carried-
+// forward revision before appending the new goal revision, so the
+// result never violates Validate's "blue/green has at most two
+// Revisions" invariant.
+func TestStepConfigBlueGreenCollapsesLeftoverRevisions(t *testing.T) {
+	goal := &ConfigurationRollout{
+		ConfigurationName: "cfg",
+		Percent:           100,
+		Mode:              RolloutModeBlueGreen,
+		Revisions:         []RevisionRollout{{RevisionName: "v3", Percent: 100}},
+	}
+	prev := &ConfigurationRollout{
+		ConfigurationName: "cfg",
+		Percent:           100,
+		Mode:              RolloutModeBlueGreen,
+		Revisions: []RevisionRollout{
+			{RevisionName: "v1", Percent: 0},
+			{RevisionName: "v2", Percent: 100},
+		},
+	}
+
+	ret := stepConfig(goal, prev, 1000, nil)
+
+	if len(ret.Revisions) != 2 {
+		t.Fatalf("Revisions = %+v, want exactly 2 (Validate rejects blue/green with more)", ret.Revisions)
+	}
+	if ret.Revisions[0].RevisionName != "v2" || ret.Revisions[0].Percent != 100 {
+		t.Fatalf("expected the currently-promoted revision carried forward at goal.Percent: %+v", ret.Revisions[0])
+	}
+	if ret.Revisions[1].RevisionName != "v3" || ret.Revisions[1].Percent != 0 {
+		t.Fatalf("expected the new goal revision held at 0%%: %+v", ret.Revisions[1])
+	}
+
+	ro := &Rollout{Configurations: []ConfigurationRollout{*ret}}
+	if !ro.Validate() {
+		t.Fatalf("Validate() = false for result %+v, want true", ret.Revisions)
+	}
+}
+
+// fakeHealthSignal is a trivial HealthSignal returning a fixed delta.
+type fakeHealthSignal struct {
+	delta float64
+	err   error
+}
+
+func (f fakeHealthSignal) ErrorRateDelta(*ConfigurationRollout) (float64, error) {
+	return f.delta, f.err
+}
+
+// TestDecideThresholds verifies Decide classifies the observed
+// error-rate delta against AdvanceThreshold/RollbackThreshold, and
+// records the sample on HealthSamples.
+func TestDecideThresholds(t *testing.T) {
+	cases := []struct {
+		name  string
+		delta float64
+		want  AdvanceDecision
+	}{
+		{"below advance threshold", 0.0, AdvanceDecisionAdvance},
+		{"between thresholds", 0.02, AdvanceDecisionHold},
+		{"at rollback threshold", 0.05, AdvanceDecisionRollback},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			goal := &ConfigurationRollout{AdvanceThreshold: 0.01, RollbackThreshold: 0.05}
+			got, err := goal.Decide(fakeHealthSignal{delta: tc.delta})
+			if err != nil {
+				t.Fatalf("Decide() error = %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("Decide() = %v, want %v", got, tc.want)
+			}
+			if goal.Decision != tc.want {
+				t.Fatalf("goal.Decision = %v, want %v", goal.Decision, tc.want)
+			}
+			if len(goal.HealthSamples) != 1 || goal.HealthSamples[0] != tc.delta {
+				t.Fatalf("HealthSamples = %v, want [%v]", goal.HealthSamples, tc.delta)
+			}
+		})
+	}
+}
+
+// TestDecideCapsHealthSamples verifies HealthSamples never grows past
+// maxHealthSamples, keeping the newest samples.
+func TestDecideCapsHealthSamples(t *testing.T) {
+	goal := &ConfigurationRollout{AdvanceThreshold: 0.5, RollbackThreshold: 0.9}
+	for i := 0; i < maxHealthSamples+3; i++ {
+		if _, err := goal.Decide(fakeHealthSignal{delta: float64(i)}); err != nil {
+			t.Fatalf("Decide() error = %v", err)
+		}
+	}
+	if len(goal.HealthSamples) != maxHealthSamples {
+		t.Fatalf("len(HealthSamples) = %d, want %d", len(goal.HealthSamples), maxHealthSamples)
+	}
+	if want := float64(maxHealthSamples + 2); goal.HealthSamples[len(goal.HealthSamples)-1] != want {
+		t.Fatalf("newest sample = %v, want %v", goal.HealthSamples[len(goal.HealthSamples)-1], want)
+	}
+}
+
+// TestStepRevisionsAdvanceDoublesStepSize verifies that an
+// AdvanceDecisionAdvance decision doubles StepSize for that tick's step,
+// per the AIMD scheme.
+func TestStepRevisionsAdvanceDoublesStepSize(t *testing.T) {
+	goal := &ConfigurationRollout{
+		Percent:      100,
+		StepSize:     5,
+		NextStepTime: 1000,
+		Decision:     AdvanceDecisionAdvance,
+		Revisions: []RevisionRollout{
+			{RevisionName: "v1", Percent: 90},
+			{RevisionName: "v2", Percent: 10},
+		},
+	}
+	stepRevisions(goal, 1000, nil)
+	if goal.StepSize != 10 {
+		t.Fatalf("StepSize = %d, want 10 (doubled)", goal.StepSize)
+	}
+	if goal.Revisions[len(goal.Revisions)-1].Percent != 20 {
+		t.Fatalf("expected newest revision to move by the doubled step: %+v", goal.Revisions)
+	}
+}
+
+// TestStepRevisionsAdvanceCapsStepSize verifies that doubling StepSize on
+// an AdvanceDecisionAdvance decision is capped at the remaining percent,
+// so a stale oversized StepSize doesn't leak into a later Rollback or
+// guardrail calculation once there's nothing left to advance.
+func TestStepRevisionsAdvanceCapsStepSize(t *testing.T) {
+	goal := &ConfigurationRollout{
+		Percent:      100,
+		StepSize:     40,
+		NextStepTime: 1000,
+		Decision:     AdvanceDecisionAdvance,
+		Revisions: []RevisionRollout{
+			{RevisionName: "v1", Percent: 10},
+			{RevisionName: "v2", Percent: 90},
+		},
+	}
+	stepRevisions(goal, 1000, nil)
+	if goal.StepSize != 10 {
+		t.Fatalf("StepSize = %d, want 10 (capped at remaining percent, not 80 doubled)", goal.StepSize)
+	}
+	if goal.Revisions[len(goal.Revisions)-1].Percent != 100 {
+		t.Fatalf("expected newest revision to reach 100%%: %+v", goal.Revisions)
+	}
+}
+
+// TestStepRevisionsHoldDecisionFreezesSplit verifies
+// AdvanceDecisionHold holds the current split and only pushes
+// NextStepTime out.
+func TestStepRevisionsHoldDecisionFreezesSplit(t *testing.T) {
+	goal := &ConfigurationRollout{
+		Percent:      100,
+		StepSize:     5,
+		StepDuration: 15,
+		NextStepTime: 1000,
+		Decision:     AdvanceDecisionHold,
+		Revisions: []RevisionRollout{
+			{RevisionName: "v1", Percent: 90},
+			{RevisionName: "v2", Percent: 10},
+		},
+	}
+	stepRevisions(goal, 1000, nil)
+	if goal.Revisions[0].Percent != 90 || goal.Revisions[1].Percent != 10 {
+		t.Fatalf("split changed on Hold: %+v", goal.Revisions)
+	}
+	if goal.NextStepTime != 1015 {
+		t.Fatalf("NextStepTime = %d, want 1015", goal.NextStepTime)
+	}
+}
+
+// TestCapStepToScaleGuardShrinksStep verifies the MaxStepReplicaFraction
+// guardrail shrinks StepSize (and pushes NextStepTime out) when the new
+// revision would otherwise have to scale beyond the allowed fraction of
+// its desired replica count to honor the full step.
+func TestCapStepToScaleGuardShrinksStep(t *testing.T) {
+	goal := &ConfigurationRollout{
+		Percent:                100,
+		StepSize:               50,
+		StepDuration:           30,
+		MaxStepReplicaFraction: 0.1, // allow only +10% of desired replicas per step
+		Revisions: []RevisionRollout{
+			{RevisionName: "v1", Percent: 60},
+			{RevisionName: "v2", Percent: 40},
+		},
+	}
+	reader := &fakeScaleReader{
+		ready:   map[string]int{"v2": 4},
+		desired: map[string]int{"v2": 10},
+	}
+
+	capStepToScaleGuard(goal, reader, 1000)
+
+	if goal.StepSize <= 0 || goal.StepSize >= 50 {
+		t.Fatalf("StepSize = %d, want shrunk below 50", goal.StepSize)
+	}
+	if goal.NextStepTime != 1030 {
+		t.Fatalf("NextStepTime = %d, want 1030", goal.NextStepTime)
+	}
+}
+
+// TestCapStepToScaleGuardDisabledWithoutFraction verifies the guardrail
+// is a no-op when MaxStepReplicaFraction is unset, regardless of
+// scaleReader data.
+func TestCapStepToScaleGuardDisabledWithoutFraction(t *testing.T) {
+	goal := &ConfigurationRollout{
+		Percent:  100,
+		StepSize: 50,
+		Revisions: []RevisionRollout{
+			{RevisionName: "v1", Percent: 60},
+			{RevisionName: "v2", Percent: 40},
+		},
+	}
+	reader := &fakeScaleReader{ready: map[string]int{"v2": 1}, desired: map[string]int{"v2": 100}}
+
+	capStepToScaleGuard(goal, reader, 1000)
+
+	if goal.StepSize != 50 {
+		t.Fatalf("StepSize = %d, want unchanged 50", goal.StepSize)
+	}
+}
+
+// TestStepRevisionsPreservesMatchedRevision verifies that a Match-pinned
+// revision sitting ahead of the newest one survives stepRevisions even
+// once its weighted Percent has been drained to 0.
+func TestStepRevisionsPreservesMatchedRevision(t *testing.T) {
+	goal := &ConfigurationRollout{
+		Percent:      100,
+		StepSize:     10,
+		NextStepTime: 1000,
+		Revisions: []RevisionRollout{
+			{RevisionName: "v1", Percent: 80},
+			{RevisionName: "canary", Percent: 0, Match: []MatchPredicate{{
+				Header: "x-canary", Name: "x-canary", ExactValue: "true",
+			}}},
+			{RevisionName: "v2", Percent: 20},
+		},
+	}
+
+	stepRevisions(goal, 1000, nil)
+
+	var canary *RevisionRollout
+	for i := range goal.Revisions {
+		if goal.Revisions[i].RevisionName == "canary" {
+			canary = &goal.Revisions[i]
+		}
+	}
+	if canary == nil {
+		t.Fatalf("Match-pinned revision was dropped: %+v", goal.Revisions)
+	}
+	if len(canary.Match) != 1 {
+		t.Fatalf("Match predicate was lost: %+v", canary)
+	}
+}
+
+// TestValidateMatchPredicate verifies that Validate enforces the
+// "exactly one of Header/Cookie" and "exactly one of ExactValue/Regex"
+// invariants documented on MatchPredicate.
+func TestValidateMatchPredicate(t *testing.T) {
+	base := func(m MatchPredicate) *Rollout {
+		return &Rollout{Configurations: []ConfigurationRollout{{
+			ConfigurationName: "cfg",
+			Percent:           100,
+			Revisions: []RevisionRollout{
+				{RevisionName: "v1", Percent: 100, Match: []MatchPredicate{m}},
+			},
+		}}}
+	}
+
+	cases := []struct {
+		name string
+		m    MatchPredicate
+		want bool
+	}{
+		{"valid header+exact", MatchPredicate{Header: "h", Name: "h", ExactValue: "v"}, true},
+		{"valid cookie+regex", MatchPredicate{Cookie: "c", Name: "c", Regex: "v.*"}, true},
+		{"neither header nor cookie", MatchPredicate{Name: "h", ExactValue: "v"}, false},
+		{"both header and cookie", MatchPredicate{Header: "h", Cookie: "c", Name: "h", ExactValue: "v"}, false},
+		{"neither exact nor regex", MatchPredicate{Header: "h", Name: "h"}, false},
+		{"both exact and regex", MatchPredicate{Header: "h", Name: "h", ExactValue: "v", Regex: "v.*"}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := base(tc.m).Validate(); got != tc.want {
+				t.Fatalf("Validate() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestStepRevisionsPostPromotionAnalysisHold verifies that reaching 100%
+// with a PostPromotionAnalysis hook configured holds the old revision
+// in place instead of dropping it in the same tick, and that it is only
+// dropped once AnalysisState moves off AnalysisRunning.
+func TestStepRevisionsPostPromotionAnalysisHold(t *testing.T) {
+	goal := &ConfigurationRollout{
+		Percent:               100,
+		StepSize:              100,
+		NextStepTime:          1000,
+		PostPromotionAnalysis: []Metric{{Name: "error-rate", Query: "q", SuccessCondition: "c"}},
+		Revisions: []RevisionRollout{
+			{RevisionName: "v1", Percent: 20},
+			{RevisionName: "v2", Percent: 80},
+		},
+	}
+
+	stepRevisions(goal, 1000, nil)
+	if len(goal.Revisions) != 2 || goal.Revisions[0].Percent != 0 || goal.Revisions[1].Percent != 100 {
+		t.Fatalf("expected 100%% checkpoint with old revision held: %+v", goal.Revisions)
+	}
+	if goal.AnalysisState != AnalysisRunning {
+		t.Fatalf("AnalysisState = %v, want AnalysisRunning", goal.AnalysisState)
+	}
+
+	// While AnalysisRunning, further ticks must not drop the old revision.
+	stepRevisions(goal, goal.NextStepTime, nil)
+	if len(goal.Revisions) != 2 {
+		t.Fatalf("old revision dropped while analysis still running: %+v", goal.Revisions)
+	}
+
+	// Once the caller (standing in for RunAnalysis) records success, the
+	// next tick finally drops the old revision.
+	goal.AnalysisState = AnalysisSucceeded
+	stepRevisions(goal, goal.NextStepTime, nil)
+	if len(goal.Revisions) != 1 || goal.Revisions[0].RevisionName != "v2" {
+		t.Fatalf("expected old revision dropped after analysis succeeded: %+v", goal.Revisions)
+	}
+}
+
+// TestStepRevisionsPrePromotionAnalysisHold verifies that reaching the
+// first 1% checkpoint with a PrePromotionAnalysis hook configured holds
+// the split there instead of stepping forward, and that it only
+// advances once AnalysisState moves off AnalysisRunning.
+func TestStepRevisionsPrePromotionAnalysisHold(t *testing.T) {
+	goal := &ConfigurationRollout{
+		Percent:              100,
+		StepSize:             10,
+		NextStepTime:         1000,
+		PrePromotionAnalysis: []Metric{{Name: "error-rate", Query: "q", SuccessCondition: "c"}},
+		Revisions: []RevisionRollout{
+			{RevisionName: "v1", Percent: 99},
+			{RevisionName: "v2", Percent: 1},
+		},
+	}
+
+	stepRevisions(goal, 1000, nil)
+	if goal.Revisions[0].Percent != 99 || goal.Revisions[1].Percent != 1 {
+		t.Fatalf("expected 1%% checkpoint held: %+v", goal.Revisions)
+	}
+	if goal.AnalysisState != AnalysisRunning {
+		t.Fatalf("AnalysisState = %v, want AnalysisRunning", goal.AnalysisState)
+	}
+
+	// While AnalysisRunning, further ticks must not advance past 1%.
+	stepRevisions(goal, goal.NextStepTime, nil)
+	if goal.Revisions[1].Percent != 1 {
+		t.Fatalf("stepped past 1%% while analysis still running: %+v", goal.Revisions)
+	}
+
+	// Once the caller (standing in for RunAnalysis) records success, the
+	// next tick finally advances the rollout forward.
+	goal.AnalysisState = AnalysisSucceeded
+	stepRevisions(goal, goal.NextStepTime, nil)
+	if goal.Revisions[1].Percent != 11 {
+		t.Fatalf("expected rollout to advance after analysis succeeded: %+v", goal.Revisions)
+	}
+}
+
+// TestRollbackSkipsMatchedRevision verifies that Rollback gives traffic
+// back to the last unmatched revision, not whatever happens to sit
+// right before the newest one, when a Match-pinned revision is in
+// between.
+func TestRollbackSkipsMatchedRevision(t *testing.T) {
+	goal := &ConfigurationRollout{
+		Percent:      100,
+		StepSize:     20,
+		NextStepTime: 1000,
+		Decision:     AdvanceDecisionRollback,
+		Revisions: []RevisionRollout{
+			{RevisionName: "v1", Percent: 60},
+			{RevisionName: "canary", Percent: 0, Match: []MatchPredicate{{
+				Header: "x-canary", Name: "x-canary", ExactValue: "true",
+			}}},
+			{RevisionName: "v2", Percent: 40},
+		},
+	}
+
+	stepRevisions(goal, 1000, nil)
+
+	for _, r := range goal.Revisions {
+		if r.RevisionName == "canary" && r.Percent != 0 {
+			t.Fatalf("Match-pinned revision received weighted traffic: %+v", goal.Revisions)
+		}
+		if r.RevisionName == "v1" && r.Percent != 80 {
+			t.Fatalf("drained traffic did not return to v1: %+v", goal.Revisions)
+		}
+	}
+}
+
+// TestDrainNewestRevisionFallsBackWhenAllUpstreamMatched verifies that
+// an emergency drain (Rollback/reverseAbortedRollout) still moves
+// traffic off newest, falling back to the oldest revision, when every
+// revision ahead of newest is Match-pinned and so has no out-of-band-
+// safe place to receive it.
+func TestDrainNewestRevisionFallsBackWhenAllUpstreamMatched(t *testing.T) {
+	goal := &ConfigurationRollout{
+		Percent:      100,
+		StepSize:     20,
+		NextStepTime: 1000,
+		Phase:        RolloutPhaseAborted,
+		Revisions: []RevisionRollout{
+			{RevisionName: "canary", Percent: 0, Match: []MatchPredicate{{
+				Header: "x-canary", Name: "x-canary", ExactValue: "true",
+			}}},
+			{RevisionName: "v2", Percent: 100},
+		},
+	}
+
+	stepRevisions(goal, 1000, nil)
+
+	if got := goal.Revisions[len(goal.Revisions)-1].Percent; got != 80 {
+		t.Fatalf("newest revision Percent = %d, want 80 (drained despite all upstream revisions being Match-pinned)", got)
+	}
+	if goal.Revisions[0].RevisionName != "canary" || goal.Revisions[0].Percent != 20 {
+		t.Fatalf("expected drained traffic to fall back onto the oldest (Match-pinned) revision: %+v", goal.Revisions)
+	}
+}
+
+// fakeMetricProvider evaluates metrics against a fixed per-name result.
+type fakeMetricProvider struct {
+	ok map[string]bool
+}
+
+func (f fakeMetricProvider) Evaluate(m Metric) (bool, error) {
+	return f.ok[m.Name], nil
+}
+
+// TestRunAnalysisTracksFailuresPerMetric verifies that one metric's
+// failures can't eat into a different metric's FailureLimit budget.
+func TestRunAnalysisTracksFailuresPerMetric(t *testing.T) {
+	metrics := []Metric{
+		{Name: "A", Query: "qa", SuccessCondition: "ca", FailureLimit: 5},
+		{Name: "B", Query: "qb", SuccessCondition: "cb", FailureLimit: 1},
+	}
+	goal := &ConfigurationRollout{}
+
+	// Tick 1: A fails, B passes. Should stay Running, nowhere near aborting.
+	state, err := goal.RunAnalysis(metrics, fakeMetricProvider{ok: map[string]bool{"A": false, "B": true}})
+	if err != nil {
+		t.Fatalf("RunAnalysis() error = %v", err)
+	}
+	if state != AnalysisRunning {
+		t.Fatalf("tick 1 state = %v, want AnalysisRunning", state)
+	}
+
+	// Tick 2: A recovers, B fails for the first time. B's own FailureLimit
+	// is 1, so a single failure must not abort the rollout yet.
+	state, err = goal.RunAnalysis(metrics, fakeMetricProvider{ok: map[string]bool{"A": true, "B": false}})
+	if err != nil {
+		t.Fatalf("RunAnalysis() error = %v", err)
+	}
+	if state != AnalysisRunning {
+		t.Fatalf("tick 2 state = %v, want AnalysisRunning (B's own first failure)", state)
+	}
+	if goal.Phase == RolloutPhaseAborted {
+		t.Fatalf("rollout aborted on B's first failure despite FailureLimit: 1")
+	}
+}
+
+// TestReverseAbortedRolloutPaced verifies that an aborted rollout only
+// unwinds once per StepDuration, same as every other path in this file,
+// rather than on every reconcile call.
+func TestReverseAbortedRolloutPaced(t *testing.T) {
+	goal := &ConfigurationRollout{
+		Percent:      100,
+		StepSize:     20,
+		StepDuration: 30,
+		NextStepTime: 1000,
+		Phase:        RolloutPhaseAborted,
+		Revisions: []RevisionRollout{
+			{RevisionName: "v1", Percent: 40},
+			{RevisionName: "v2", Percent: 60},
+		},
+	}
+
+	stepRevisions(goal, 1000, nil)
+	if goal.Revisions[1].Percent != 40 {
+		t.Fatalf("expected one step of drain, got %+v", goal.Revisions)
+	}
+
+	// Before NextStepTime, a second call on the same tick must not drain again.
+	stepRevisions(goal, 1010, nil)
+	if goal.Revisions[1].Percent != 40 {
+		t.Fatalf("drained again before StepDuration elapsed: %+v", goal.Revisions)
+	}
+
+	stepRevisions(goal, 1030, nil)
+	if goal.Revisions[1].Percent != 20 {
+		t.Fatalf("expected a second step of drain at NextStepTime: %+v", goal.Revisions)
+	}
+}
+
+// TestStepRevisionsBlueGreenScaleDownDelay verifies the old revision
+// stays in Revisions at 0% for ScaleDownDelay after cutover, and is
+// only dropped afterwards.
+func TestStepRevisionsBlueGreenScaleDownDelay(t *testing.T) {
+	goal := blueGreenGoal()
+	goal.AutoPromote = true
+	goal.ScaleDownDelay = 60 * time.Second
+	goal.NextStepTime = 1000
+
+	stepRevisions(goal, 1000, nil)
+	if len(goal.Revisions) != 2 || goal.Revisions[0].Percent != 0 || goal.Revisions[1].Percent != 100 {
+		t.Fatalf("expected cutover keeping old at 0%%: %+v", goal.Revisions)
+	}
+	if goal.NextStepTime != 1060 {
+		t.Fatalf("NextStepTime after cutover = %d, want 1060", goal.NextStepTime)
+	}
+
+	// Before ScaleDownDelay elapses, old revision must remain addressable.
+	stepRevisions(goal, 1030, nil)
+	if len(goal.Revisions) != 2 {
+		t.Fatalf("old revision dropped before ScaleDownDelay elapsed: %+v", goal.Revisions)
+	}
+
+	stepRevisions(goal, 1060, nil)
+	if len(goal.Revisions) != 1 || goal.Revisions[0].RevisionName != "new" {
+		t.Fatalf("expected old revision dropped after ScaleDownDelay: %+v", goal.Revisions)
+	}
+}